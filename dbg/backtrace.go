@@ -21,22 +21,209 @@ package dbg
 
 import (
 	"fmt"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // numTotalFrames specifies the maximum number of frames that are supported by
 // backtrace APIs.
 const numTotalFrames = 100
 
+const (
+	// minStackSize and minAllStackSize are the initial buffer sizes used by
+	// stacks, for a single goroutine and for BacktraceAll(true) respectively.
+	// The buffer doubles from there until the dump fits or defaultMaxBytes
+	// (or a BacktraceMaxBytes ceiling) is reached.
+	minStackSize    = 10 * 1024
+	minAllStackSize = 100 * 1024
+
+	// defaultMaxBytes is the BacktraceMaxBytes ceiling used when none was
+	// given explicitly.
+	defaultMaxBytes = 16 * 1024 * 1024
+
+	// truncatedSuffix is appended to a BacktraceAll(true) dump that hit the
+	// BacktraceMaxBytes ceiling, so callers can tell a short dump from a
+	// silently cut-off one.
+	truncatedSuffix = "\n...truncated...\n"
+)
+
+// Frame is a single parsed stack frame, as captured by Backtrace or
+// BacktraceAll. Func is the bare function symbol (e.g.
+// "github.com/x/y.Foo"), with no call syntax or printed arguments, in both
+// capture modes.
+type Frame struct {
+	Func string
+	File string
+	Line int
+}
+
+// Goroutine is the structured form of one goroutine's stack, as captured by
+// Backtrace(BacktraceAll(true)) and parsed by ParseGoroutines.
+type Goroutine struct {
+	ID             int
+	State          string
+	WaitMinutes    int
+	LockedToThread bool
+	CreatedBy      string
+	Frames         []Frame
+}
+
 type traceT struct {
-	buf       []byte
+	frames    []Frame
+	buf       []byte // raw runtime.Stack(true) output, only set when all is true
 	all       bool
 	skip      int
 	numframes int
+	filter    func(runtime.Frame) bool
+	first     bool
+	maxBytes  int
 }
 
 func (t traceT) String() string {
-	return string(t.buf)
+	if t.all {
+		return string(t.buf)
+	}
+	var s string
+	for _, f := range t.frames {
+		s += fmt.Sprintf("%s():\n\t%s:%v\n", f.Func, f.File, f.Line)
+	}
+	return s
+}
+
+// MarshalLog implements logr.Marshaler, returning structured frame data
+// instead of the pre-formatted string returned by String. For a regular
+// backtrace this is a []Frame; for a BacktraceAll(true) trace it is a
+// []Goroutine, one entry per goroutine. If the raw dump can't be parsed
+// (e.g. it got cut short by BacktraceMaxBytes), the raw string is returned
+// instead so logging never fails outright.
+func (t traceT) MarshalLog() interface{} {
+	if t.all {
+		gs, err := ParseGoroutines(t.buf)
+		if err != nil {
+			return string(t.buf)
+		}
+		return gs
+	}
+	return t.frames
+}
+
+// goroutineHeaderRE matches the "goroutine N [state, ...]:" line that starts
+// each goroutine's block in the output of runtime.Stack(true), e.g.
+// "goroutine 7 [chan receive, 5 minutes, locked to thread]:".
+var goroutineHeaderRE = regexp.MustCompile(`^goroutine (\d+) \[(.+)\]:$`)
+
+// waitMinutesRE matches the "N minutes" (or "N minute") annotation inside a
+// goroutine header's bracketed state.
+var waitMinutesRE = regexp.MustCompile(`^(\d+) minutes?$`)
+
+// frameLocationRE matches the "\tfile:line +0xNN" line that follows a frame's
+// function line in the output of runtime.Stack.
+var frameLocationRE = regexp.MustCompile(`^\t(.+):(\d+)(?: \+0x[0-9a-f]+)?$`)
+
+// createdByRE matches the "created by funcname" line, stripping the
+// "in goroutine N" suffix that Go 1.21+ appends.
+var createdByRE = regexp.MustCompile(`^created by (.+?)(?: in goroutine \d+)?$`)
+
+// callArgsRE matches the trailing "(args...)" call syntax that
+// runtime.Stack prints after a frame's function name, so it can be stripped
+// to leave the bare symbol, matching what Frame.Func holds for a regular
+// Backtrace(). It's anchored on a parenthesized group with no nested
+// parens, so it only matches the final argument list and not a
+// pointer-receiver's "(*T)" that may appear earlier in the same line, e.g.
+// "pkg.(*Worker).Run(0xc0000a4000, 0x1)".
+var callArgsRE = regexp.MustCompile(`\([^()]*\)$`)
+
+// ParseGoroutines parses the output of runtime.Stack(true) (the same format
+// produced by Backtrace(BacktraceAll(true))) into one Goroutine per
+// goroutine block.
+func ParseGoroutines(buf []byte) ([]Goroutine, error) {
+	trimmed := strings.TrimRight(string(buf), "\n")
+	if trimmed == "" {
+		return nil, fmt.Errorf("dbg: no goroutine dump to parse")
+	}
+
+	var result []Goroutine
+	for _, block := range strings.Split(trimmed, "\n\n") {
+		if block == "" {
+			continue
+		}
+		g, err := parseGoroutineBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, g)
+	}
+
+	return result, nil
+}
+
+// parseGoroutineBlock parses a single "goroutine N [...]:" block, including
+// its header, frames and trailing "created by" line if present.
+func parseGoroutineBlock(block string) (Goroutine, error) {
+	lines := strings.Split(block, "\n")
+
+	m := goroutineHeaderRE.FindStringSubmatch(lines[0])
+	if m == nil {
+		return Goroutine{}, fmt.Errorf("dbg: malformed goroutine header: %q", lines[0])
+	}
+	id, err := strconv.Atoi(m[1])
+	if err != nil {
+		return Goroutine{}, fmt.Errorf("dbg: invalid goroutine id in header %q: %w", lines[0], err)
+	}
+
+	g := Goroutine{ID: id}
+	attrs := strings.Split(m[2], ", ")
+	g.State = attrs[0]
+	for _, attr := range attrs[1:] {
+		switch {
+		case attr == "locked to thread":
+			g.LockedToThread = true
+		case waitMinutesRE.MatchString(attr):
+			g.WaitMinutes, _ = strconv.Atoi(waitMinutesRE.FindStringSubmatch(attr)[1])
+		}
+	}
+
+	for i := 1; i+1 < len(lines); i += 2 {
+		if m := createdByRE.FindStringSubmatch(lines[i]); m != nil {
+			g.CreatedBy = m[1]
+			break
+		}
+		loc := frameLocationRE.FindStringSubmatch(lines[i+1])
+		if loc == nil {
+			break
+		}
+		line, err := strconv.Atoi(loc[2])
+		if err != nil {
+			break
+		}
+		g.Frames = append(g.Frames, Frame{Func: callArgsRE.ReplaceAllString(lines[i], ""), File: loc[1], Line: line})
+	}
+
+	return g, nil
+}
+
+// GroupByStack buckets goroutines that share an identical sequence of
+// frames, keyed by a string representation of that stack. It's meant for
+// spotting goroutine leaks at a glance, e.g. "50 goroutines blocked on the
+// same chan receive".
+func GroupByStack(gs []Goroutine) map[string][]Goroutine {
+	groups := make(map[string][]Goroutine)
+	for _, g := range gs {
+		key := stackKey(g.Frames)
+		groups[key] = append(groups[key], g)
+	}
+	return groups
+}
+
+func stackKey(frames []Frame) string {
+	var b strings.Builder
+	for _, f := range frames {
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", f.Func, f.File, f.Line)
+	}
+	return b.String()
 }
 
 // BacktraceOption provides functional parameters for Backtrace.
@@ -61,8 +248,9 @@ func BacktraceSkip(depth int) BacktraceOption {
 }
 
 // BacktraceSize will limit how far the unwinding goes, i.e. specify
-// how many stack frames will be printed. Has no effect when
-// combined with BacktraceAll(true).
+// how many stack frames will be printed. It counts frames that pass the
+// filter installed via BacktraceFilter, not raw stack entries. Has no
+// effect when combined with BacktraceAll(true).
 func BacktraceSize(numFrames int) BacktraceOption {
 	return func(t *traceT) {
 		if numFrames > 0 {
@@ -71,6 +259,58 @@ func BacktraceSize(numFrames int) BacktraceOption {
 	}
 }
 
+// BacktraceFilter restricts the captured backtrace to the frames for which
+// filter returns true. It is applied after inlined calls have been expanded
+// into their own frames (see runtime.CallersFrames), so a filter can match
+// or exclude an inlined function just like any other. Has no effect when
+// combined with BacktraceAll(true).
+func BacktraceFilter(filter func(frame runtime.Frame) bool) BacktraceOption {
+	return func(t *traceT) {
+		t.filter = filter
+	}
+}
+
+// BacktraceFirst stops the capture at the first frame that passes the
+// filter installed via BacktraceFilter (or the first frame overall, if no
+// filter was given). It is typically combined with BacktraceFilter to
+// locate the first "programmer" frame, skipping logging wrappers and
+// runtime plumbing. Has no effect when combined with BacktraceAll(true).
+func BacktraceFirst() BacktraceOption {
+	return func(t *traceT) {
+		t.first = true
+	}
+}
+
+// BacktracePackagePrefixes returns a BacktraceFilter that drops any frame
+// whose function name starts with one of the given prefixes. A typical use
+// is hiding runtime and testing plumbing as well as the caller's own
+// logging wrapper, e.g. BacktracePackagePrefixes([]string{"runtime.",
+// "testing.", "github.com/example/log."}).
+func BacktracePackagePrefixes(skip []string) BacktraceOption {
+	return BacktraceFilter(func(frame runtime.Frame) bool {
+		for _, prefix := range skip {
+			if strings.HasPrefix(frame.Function, prefix) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// BacktraceMaxBytes caps how large a BacktraceAll(true) dump is allowed to
+// grow while stacks retries runtime.Stack with an ever bigger buffer. Once
+// n bytes is reached without the dump fitting, the dump is returned as-is
+// with a "...truncated..." marker appended instead of growing further.
+// Defaults to a generous but bounded size if not given. Has no effect
+// without BacktraceAll(true).
+func BacktraceMaxBytes(n int) BacktraceOption {
+	return func(t *traceT) {
+		if n > 0 {
+			t.maxBytes = n
+		}
+	}
+}
+
 // Backtrace returns an object that as default represents the stack backtrace of the calling
 // goroutine. That object can be used as value in a structured logging call.
 // It supports printing as string or as structured output via logr.MarshalLog.
@@ -85,11 +325,13 @@ func Backtrace(opts ...BacktraceOption) interface{} {
 
 	// 'All' supersedes skip/size etc
 	if trace.all {
-		trace.buf = stacks(true)
+		trace.buf = stacks(true, trace.maxBytes)
 		return trace
 	}
 
-	pc := make([]uintptr, numTotalFrames)
+	pcPtr := pcPool.Get().(*[]uintptr)
+	defer pcPool.Put(pcPtr)
+	pc := *pcPtr
 	// skip runtime.Callers and the klog.Backtrace API
 	n := runtime.Callers(trace.skip+2, pc)
 
@@ -110,43 +352,122 @@ func Backtrace(opts ...BacktraceOption) interface{} {
 	// pass only valid pcs to runtime.CallersFrames (remove goexit..)
 	pc = pc[:n-1]
 
-	// Account for "size" parameter
-	if trace.numframes > 0 && trace.numframes < n {
-		pc = pc[:trace.numframes]
-	}
-
 	frames := runtime.CallersFrames(pc)
 
-	var s string
 	for {
 		frame, more := frames.Next()
-		s += fmt.Sprintf("%s():\n\t%s:%v\n", frame.Function, frame.File, frame.Line)
+		if trace.filter == nil || trace.filter(frame) {
+			trace.frames = append(trace.frames, Frame{Func: frame.Function, File: frame.File, Line: frame.Line})
+			if trace.first || (trace.numframes > 0 && len(trace.frames) >= trace.numframes) {
+				break
+			}
+		}
 		if !more {
 			break
 		}
 	}
-	if s != "" {
-		trace.buf = []byte(s)
-	}
 
 	return trace
 }
 
-// stacks is a wrapper for runtime.Stack that attempts to recover the data for all goroutines.
-func stacks(all bool) []byte {
-	// We don't know how big the traces are, so grow a few times if they don't fit. Start large, though.
-	n := 10000
+// pcPool holds reusable []uintptr buffers for runtime.Callers, sized to
+// numTotalFrames. The PCs themselves never escape Backtrace: they're
+// consumed into Frame values before the buffer goes back to the pool.
+var pcPool = sync.Pool{
+	New: func() interface{} {
+		pcs := make([]uintptr, numTotalFrames)
+		return &pcs
+	},
+}
+
+// stacks is a wrapper for runtime.Stack that attempts to recover the data
+// for all goroutines (or just the current one). We don't know up front how
+// big the dump will be, so it grows the buffer, by size class, until
+// runtime.Stack reports it didn't fill it or maxBytes is reached.
+func stacks(all bool, maxBytes int) []byte {
+	n := minStackSize
 	if all {
-		n = 100000
+		n = minAllStackSize
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBytes
 	}
-	var trace []byte
-	for i := 0; i < 5; i++ {
-		trace = make([]byte, n)
-		nbytes := runtime.Stack(trace, all)
-		if nbytes < len(trace) {
-			return trace[:nbytes]
+	if n > maxBytes {
+		n = maxBytes
+	}
+
+	for {
+		buf := stackBufPool.get(n)
+		nbytes := runtime.Stack(buf, all)
+		full := nbytes >= len(buf)
+
+		var out []byte
+		if !full || n >= maxBytes {
+			// Copy out before the buffer goes back to the pool: nothing we
+			// hand to the caller may alias pooled memory another goroutine
+			// could reuse (and overwrite) right after Put.
+			out = append([]byte(nil), buf[:nbytes]...)
+		}
+		stackBufPool.put(buf)
+
+		if !full {
+			return out
+		}
+		if n >= maxBytes {
+			return append(out, truncatedSuffix...)
 		}
+
 		n *= 2
+		if n > maxBytes {
+			n = maxBytes
+		}
 	}
-	return trace
 }
+
+// sizedBufPool is a set of sync.Pool instances, one per distinct buffer size
+// ever requested via get. Pooling by exact size (rather than one pool that
+// hands out "at least this big" buffers) keeps Put/Get trivial and avoids
+// wasting memory on oversized buffers for the common, smaller size classes.
+type sizedBufPool struct {
+	mu    sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+func newSizedBufPool() *sizedBufPool {
+	return &sizedBufPool{pools: map[int]*sync.Pool{}}
+}
+
+func (p *sizedBufPool) get(size int) []byte {
+	p.mu.Lock()
+	sp, ok := p.pools[size]
+	if !ok {
+		sp = &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		}
+		p.pools[size] = sp
+	}
+	p.mu.Unlock()
+
+	return *sp.Get().(*[]byte)
+}
+
+func (p *sizedBufPool) put(buf []byte) {
+	size := cap(buf)
+
+	p.mu.Lock()
+	sp, ok := p.pools[size]
+	p.mu.Unlock()
+	if !ok {
+		// Nothing has ever called get(size), so there's no pool for it;
+		// this shouldn't happen given how get/put are used above.
+		return
+	}
+
+	buf = buf[:size]
+	sp.Put(&buf)
+}
+
+var stackBufPool = newSizedBufPool()
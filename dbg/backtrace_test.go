@@ -191,3 +191,219 @@ func TestBacktraceAll(t *testing.T) {
 		t.Errorf("Expected more than 1 goroutine stack to be printed, got:\n%s", actual)
 	}
 }
+
+// wrapperFrame is a trivial one-line function, the kind the compiler likes
+// to inline into its caller. The filtering tests below rely on it being
+// dropped by name regardless of whether the compiler actually inlines it:
+// runtime.CallersFrames always expands inlined calls back into their own
+// frame.
+func wrapperFrame(callback func() interface{}) interface{} { return callback() }
+
+func frameFuncs(t *testing.T, backtrace interface{}) []string {
+	marshaler, ok := backtrace.(interface{ MarshalLog() interface{} })
+	if !ok {
+		t.Fatal("expected logr.Marshaler")
+	}
+	frames, ok := marshaler.MarshalLog().([]dbg.Frame)
+	if !ok {
+		t.Fatalf("expected []dbg.Frame, got %T", marshaler.MarshalLog())
+	}
+	var funcs []string
+	for _, f := range frames {
+		funcs = append(funcs, f.Func)
+	}
+	return funcs
+}
+
+func TestBacktraceFilter(t *testing.T) {
+	backtrace := wrapperFrame(func() interface{} {
+		return dbg.Backtrace(dbg.BacktraceFilter(func(frame runtime.Frame) bool {
+			return !strings.HasSuffix(frame.Function, "dbg_test.wrapperFrame")
+		}))
+	})
+
+	for _, fn := range frameFuncs(t, backtrace) {
+		if strings.HasSuffix(fn, "dbg_test.wrapperFrame") {
+			t.Errorf("expected wrapperFrame to be filtered out, got frames: %v", frameFuncs(t, backtrace))
+		}
+	}
+}
+
+func TestBacktracePackagePrefixes(t *testing.T) {
+	backtrace := wrapperFrame(func() interface{} {
+		return dbg.Backtrace(dbg.BacktracePackagePrefixes([]string{"github.com/go-logr/lib/dbg_test.wrapperFrame"}))
+	})
+
+	for _, fn := range frameFuncs(t, backtrace) {
+		if strings.HasPrefix(fn, "github.com/go-logr/lib/dbg_test.wrapperFrame") {
+			t.Errorf("expected wrapperFrame to be filtered out, got frames: %v", frameFuncs(t, backtrace))
+		}
+	}
+}
+
+func TestBacktraceFirst(t *testing.T) {
+	backtrace := outer(func() interface{} {
+		return dbg.Backtrace(dbg.BacktraceFirst())
+	})
+
+	funcs := frameFuncs(t, backtrace)
+	if len(funcs) != 1 {
+		t.Fatalf("expected exactly one frame, got %v", funcs)
+	}
+	if !strings.Contains(funcs[0], "dbg_test.TestBacktraceFirst") {
+		t.Errorf("expected the caller's own frame, got %q", funcs[0])
+	}
+}
+
+func TestBacktraceFirstWithFilter(t *testing.T) {
+	// The closure is dropped as well, so that without the filter the first
+	// frame would be the closure and the next one wrapperFrame.
+	backtrace := wrapperFrame(func() interface{} {
+		return dbg.Backtrace(
+			dbg.BacktraceFirst(),
+			dbg.BacktracePackagePrefixes([]string{
+				"github.com/go-logr/lib/dbg_test.TestBacktraceFirstWithFilter.func",
+				"github.com/go-logr/lib/dbg_test.wrapperFrame",
+			}),
+		)
+	})
+
+	funcs := frameFuncs(t, backtrace)
+	if len(funcs) != 1 {
+		t.Fatalf("expected exactly one frame, got %v", funcs)
+	}
+	if strings.HasPrefix(funcs[0], "github.com/go-logr/lib/dbg_test.wrapperFrame") {
+		t.Errorf("expected wrapperFrame to be skipped, got %q", funcs[0])
+	}
+	if !strings.HasSuffix(funcs[0], "dbg_test.TestBacktraceFirstWithFilter") {
+		t.Errorf("expected the first non-filtered frame to be the test func, got %q", funcs[0])
+	}
+}
+
+func TestBacktraceMaxBytes(t *testing.T) {
+	stringer, ok := dbg.Backtrace(dbg.BacktraceAll(true), dbg.BacktraceMaxBytes(1)).(fmt.Stringer)
+	if !ok {
+		t.Fatal("expected fmt.Stringer")
+	}
+	actual := stringer.String()
+	if !strings.HasSuffix(actual, "...truncated...\n") {
+		t.Errorf("expected a truncation marker, got:\n%s", actual)
+	}
+}
+
+// BenchmarkBacktrace exercises the common, non-all path: it should not
+// allocate a fresh PC buffer on every call.
+func BenchmarkBacktrace(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = dbg.Backtrace()
+	}
+}
+
+// sampleGoroutineDump matches the format produced by runtime.Stack(true) on
+// Go 1.21+: the "created by" line carries an "in goroutine N" suffix, and
+// frame lines include the call's printed arguments.
+const sampleGoroutineDump = `goroutine 7 [chan receive, 5 minutes]:
+main.worker(0x1, 0x2)
+	/app/worker.go:42 +0x85
+created by main.main in goroutine 1
+	/app/main.go:10 +0x25
+
+goroutine 8 [chan receive, 2 minutes]:
+main.worker(0x3, 0x4)
+	/app/worker.go:42 +0x85
+created by main.main in goroutine 1
+	/app/main.go:11 +0x4b
+
+goroutine 1 [running, locked to thread]:
+main.main()
+	/app/main.go:15 +0x19c
+`
+
+func TestParseGoroutines(t *testing.T) {
+	gs, err := dbg.ParseGoroutines([]byte(sampleGoroutineDump))
+	if err != nil {
+		t.Fatalf("ParseGoroutines: %v", err)
+	}
+	if len(gs) != 3 {
+		t.Fatalf("expected 3 goroutines, got %d: %+v", len(gs), gs)
+	}
+
+	worker := gs[0]
+	if worker.ID != 7 || worker.State != "chan receive" || worker.WaitMinutes != 5 {
+		t.Errorf("unexpected goroutine 7: %+v", worker)
+	}
+	if worker.CreatedBy != "main.main" {
+		t.Errorf("expected CreatedBy %q, got %q", "main.main", worker.CreatedBy)
+	}
+	if len(worker.Frames) != 1 || worker.Frames[0].Func != "main.worker" || worker.Frames[0].Line != 42 {
+		t.Errorf("unexpected frames for goroutine 7: %+v", worker.Frames)
+	}
+
+	main := gs[2]
+	if main.ID != 1 || main.State != "running" || !main.LockedToThread {
+		t.Errorf("unexpected goroutine 1: %+v", main)
+	}
+}
+
+func TestParseGoroutinesPointerReceiver(t *testing.T) {
+	const dump = `goroutine 9 [running]:
+main.(*Worker).Run(0xc0000a4000, 0x1)
+	/app/worker.go:50 +0x12
+`
+	gs, err := dbg.ParseGoroutines([]byte(dump))
+	if err != nil {
+		t.Fatalf("ParseGoroutines: %v", err)
+	}
+	if len(gs) != 1 || len(gs[0].Frames) != 1 {
+		t.Fatalf("unexpected result: %+v", gs)
+	}
+	if got, want := gs[0].Frames[0].Func, "main.(*Worker).Run"; got != want {
+		t.Errorf("Func = %q, want %q", got, want)
+	}
+}
+
+func TestParseGoroutinesInvalid(t *testing.T) {
+	if _, err := dbg.ParseGoroutines(nil); err == nil {
+		t.Error("expected an error for an empty dump")
+	}
+	if _, err := dbg.ParseGoroutines([]byte("not a goroutine dump")); err == nil {
+		t.Error("expected an error for a malformed header")
+	}
+}
+
+func TestGroupByStack(t *testing.T) {
+	gs, err := dbg.ParseGoroutines([]byte(sampleGoroutineDump))
+	if err != nil {
+		t.Fatalf("ParseGoroutines: %v", err)
+	}
+
+	groups := dbg.GroupByStack(gs)
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 distinct stacks, got %d: %+v", len(groups), groups)
+	}
+
+	for _, g := range groups {
+		if len(g) == 2 {
+			ids := []int{g[0].ID, g[1].ID}
+			if ids[0] != 7 || ids[1] != 8 {
+				t.Errorf("expected goroutines 7 and 8 grouped together, got %v", ids)
+			}
+		}
+	}
+}
+
+func TestBacktraceAllMarshalLog(t *testing.T) {
+	backtrace := dbg.Backtrace(dbg.BacktraceAll(true))
+	marshaler, ok := backtrace.(interface{ MarshalLog() interface{} })
+	if !ok {
+		t.Fatal("expected logr.Marshaler")
+	}
+	gs, ok := marshaler.MarshalLog().([]dbg.Goroutine)
+	if !ok {
+		t.Fatalf("expected []dbg.Goroutine, got %T", marshaler.MarshalLog())
+	}
+	if len(gs) < 2 {
+		t.Errorf("expected more than 1 goroutine, got %d", len(gs))
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2022 The logr Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dbg
+
+import "errors"
+
+// backtraceError wraps an error with a Backtrace captured at the point
+// WithBacktrace was called.
+type backtraceError struct {
+	err   error
+	trace interface{}
+}
+
+func (e *backtraceError) Error() string { return e.err.Error() }
+
+func (e *backtraceError) Unwrap() error { return e.err }
+
+// Backtrace returns the trace captured when this error was wrapped, in the
+// same form as returned by Backtrace.
+func (e *backtraceError) Backtrace() interface{} { return e.trace }
+
+// logMarshaler mirrors logr.Marshaler. It's declared locally so that dbg
+// doesn't have to depend on logr just to support it.
+type logMarshaler interface {
+	MarshalLog() interface{}
+}
+
+// MarshalLog implements logr.Marshaler, rendering both the wrapped error's
+// message and its structured backtrace frames under separate keys.
+func (e *backtraceError) MarshalLog() interface{} {
+	var frames interface{}
+	if m, ok := e.trace.(logMarshaler); ok {
+		frames = m.MarshalLog()
+	}
+	return struct {
+		Error     string      `json:"error"`
+		Backtrace interface{} `json:"backtrace"`
+	}{
+		Error:     e.err.Error(),
+		Backtrace: frames,
+	}
+}
+
+// WithBacktrace wraps err with a Backtrace captured at the call site
+// (skip defaults to 1, so the caller's own frame ends up on top; pass
+// BacktraceSkip to adjust). The backtrace is captured eagerly, since that's
+// the only way to get the right frames: the frames are resolved into
+// []Frame at that point, but formatting them as a string is deferred to
+// String, so wrapping an error that never gets logged costs no more than
+// the capture itself.
+//
+// Returns nil if err is nil.
+func WithBacktrace(err error, opts ...BacktraceOption) error {
+	if err == nil {
+		return nil
+	}
+	opts = append([]BacktraceOption{BacktraceSkip(1)}, opts...)
+	return &backtraceError{err: err, trace: Backtrace(opts...)}
+}
+
+// BacktraceFromError walks err's Unwrap chain for the innermost error
+// attached via WithBacktrace, returning its backtrace (in the same form as
+// returned by Backtrace), or nil if none of the chain was wrapped that way.
+func BacktraceFromError(err error) interface{} {
+	var trace interface{}
+	for err != nil {
+		var be *backtraceError
+		if !errors.As(err, &be) {
+			break
+		}
+		trace = be.trace
+		err = be.err
+	}
+	return trace
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2022 The logr Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dbg_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/lib/dbg"
+)
+
+func TestWithBacktraceNil(t *testing.T) {
+	if err := dbg.WithBacktrace(nil); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
+
+func TestWithBacktrace(t *testing.T) {
+	cause := errors.New("boom")
+	err := dbg.WithBacktrace(cause)
+
+	if err.Error() != cause.Error() {
+		t.Errorf("expected Error() %q, got %q", cause.Error(), err.Error())
+	}
+	if !errors.Is(err, cause) {
+		t.Error("expected errors.Is to find the wrapped cause")
+	}
+
+	type backtracer interface{ Backtrace() interface{} }
+	bt, ok := err.(backtracer)
+	if !ok {
+		t.Fatal("expected the wrapped error to implement Backtrace() interface{}")
+	}
+	frames := frameFuncs(t, bt.Backtrace())
+	if len(frames) == 0 || !strings.Contains(frames[0], "dbg_test.TestWithBacktrace") {
+		t.Errorf("expected the caller's own frame on top, got %v", frames)
+	}
+}
+
+func TestBacktraceFromError(t *testing.T) {
+	err := fmt.Errorf("wrapping: %w", dbg.WithBacktrace(errors.New("boom")))
+
+	trace := dbg.BacktraceFromError(err)
+	if trace == nil {
+		t.Fatal("expected a backtrace to be found")
+	}
+	frames := frameFuncs(t, trace)
+	if len(frames) == 0 || !strings.Contains(frames[0], "dbg_test.TestBacktraceFromError") {
+		t.Errorf("expected the capture site's frame on top, got %v", frames)
+	}
+}
+
+func TestBacktraceFromErrorNoMatch(t *testing.T) {
+	if trace := dbg.BacktraceFromError(errors.New("boom")); trace != nil {
+		t.Errorf("expected nil, got %v", trace)
+	}
+}
+
+func TestBacktraceFromErrorInnermost(t *testing.T) {
+	inner := dbg.WithBacktrace(errors.New("root cause"))
+	outer := dbg.WithBacktrace(fmt.Errorf("while handling: %w", inner))
+
+	trace := dbg.BacktraceFromError(outer)
+	innerFrames := frameFuncs(t, dbg.BacktraceFromError(inner))
+	gotFrames := frameFuncs(t, trace)
+
+	if len(gotFrames) == 0 || len(innerFrames) == 0 || gotFrames[0] != innerFrames[0] {
+		t.Errorf("expected the innermost backtrace, got %v, want top frame %v", gotFrames, innerFrames[:1])
+	}
+
+	// Both wraps happen in this function, so only the line of the top
+	// frame tells the inner trace from the outer one.
+	topLine := func(trace interface{}) int {
+		frames := trace.(interface{ MarshalLog() interface{} }).MarshalLog().([]dbg.Frame)
+		if len(frames) == 0 {
+			t.Fatal("expected at least one frame")
+		}
+		return frames[0].Line
+	}
+	if got, want := topLine(trace), topLine(dbg.BacktraceFromError(inner)); got != want {
+		t.Errorf("expected the innermost backtrace, got top frame at line %d, want line %d", got, want)
+	}
+}
+
+func TestWithBacktraceMarshalLog(t *testing.T) {
+	err := dbg.WithBacktrace(errors.New("boom"))
+
+	marshaler, ok := err.(interface{ MarshalLog() interface{} })
+	if !ok {
+		t.Fatal("expected logr.Marshaler")
+	}
+	logged := marshaler.MarshalLog()
+
+	out := fmt.Sprintf("%+v", logged)
+	if !strings.Contains(out, "boom") {
+		t.Errorf("expected the error message in the marshaled output, got %s", out)
+	}
+}